@@ -0,0 +1,22 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin
+
+package go9p
+
+import (
+	"syscall"
+	"time"
+)
+
+// atime returns st's last-access time.
+func atime(st *syscall.Stat_t) time.Time {
+	return time.Unix(st.Atimespec.Unix())
+}
+
+// ctime returns st's last-status-change time.
+func ctime(st *syscall.Stat_t) time.Time {
+	return time.Unix(st.Ctimespec.Unix())
+}
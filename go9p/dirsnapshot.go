@@ -0,0 +1,167 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"container/list"
+	"os"
+	"sort"
+	"sync"
+)
+
+// dirSnapshot is a point-in-time, read-only capture of a directory's
+// entries. cookies[i] is the cumulative byte offset entries[i] starts at
+// once packed for a legacy Tread, which is also a stable identity: unlike
+// fid.dirs's old cursor, a cookie keeps meaning the same entry no matter
+// how many other Treads (sequential, random-offset, or concurrent on the
+// same fid) have happened since the snapshot was built. Treaddir's
+// dialect instead uses positions in its listing as cookies: Ufs.Readdir
+// puts "." and ".." first, so entries[i] resumes at cookie i+2 and its
+// dirent carries Offset i+3.
+type dirSnapshot struct {
+	entries []*Dir
+	cookies []uint64
+}
+
+// newDirSnapshot packs every entry of infos once against scratch space of
+// its own, recording each one's cumulative byte offset as its cookie.
+func newDirSnapshot(infos []os.FileInfo, dotu bool, upool Users, readlink func(name string) (string, error)) *dirSnapshot {
+	snap := &dirSnapshot{
+		entries: make([]*Dir, len(infos)),
+		cookies: make([]uint64, len(infos)),
+	}
+
+	scratch := make([]byte, 65536)
+	var cookie uint64
+	for i, info := range infos {
+		name := info.Name()
+		d := dir2Dir(name, info, dotu, upool, func() (string, error) {
+			return readlink(name)
+		})
+
+		snap.entries[i] = d
+		snap.cookies[i] = cookie
+		cookie += uint64(PackDir(d, scratch, dotu))
+	}
+
+	return snap
+}
+
+// newDirSnapshotFromDirs builds a dirSnapshot directly from already-built
+// Dir records, for Filesystem implementations (MemFS) that have no
+// os.FileInfo of their own to hand newDirSnapshot.
+func newDirSnapshotFromDirs(dirs []*Dir, dotu bool) *dirSnapshot {
+	snap := &dirSnapshot{
+		entries: dirs,
+		cookies: make([]uint64, len(dirs)),
+	}
+
+	scratch := make([]byte, 65536)
+	var cookie uint64
+	for i, d := range dirs {
+		snap.cookies[i] = cookie
+		cookie += uint64(PackDir(d, scratch, dotu))
+	}
+
+	return snap
+}
+
+// readAt packs entries starting at the first cookie >= offset into buf,
+// stopping when an entry doesn't fit. It never mutates the snapshot, so
+// any number of callers can call readAt concurrently, each with its own
+// offset.
+func (snap *dirSnapshot) readAt(offset uint64, buf []byte, dotu bool) int {
+	i := sort.Search(len(snap.cookies), func(i int) bool {
+		return snap.cookies[i] >= offset
+	})
+
+	var count int
+	b := buf
+	for ; i < len(snap.entries); i++ {
+		sz := PackDir(snap.entries[i], b, dotu)
+		if sz == 0 {
+			break
+		}
+		b = b[sz:]
+		count += sz
+	}
+
+	return count
+}
+
+// dirSnapshotCache is a bounded, least-recently-touched eviction policy
+// over which fids are allowed to keep a dirSnap alive at once. It bounds
+// LocalFS's memory use under many open, rarely-read directory fids
+// without needing each fid to expire its own snapshot on a timer.
+type dirSnapshotCache struct {
+	mu    sync.Mutex
+	cap   int
+	ll    *list.List
+	elems map[*ufsFid]*list.Element
+}
+
+func newDirSnapshotCache(cap int) *dirSnapshotCache {
+	return &dirSnapshotCache{cap: cap, ll: list.New(), elems: map[*ufsFid]*list.Element{}}
+}
+
+// touch marks fid as the most recently read directory fid, evicting
+// whichever fid(s) have gone longest unread if that pushes the cache
+// over its cap. The call is expected to arrive with fid.dirSnapMu
+// already held (dirSnapshotFor holds it across its whole
+// build-then-touch sequence), so touch must never try to take some
+// other fid's dirSnapMu while holding c.mu: a concurrent
+// dirSnapshotFor(victim) holding victim.dirSnapMu and blocked on c.mu
+// would deadlock against it (AB-BA). Instead, unlink victims from the
+// LRU under c.mu alone and clear their dirSnap afterward, each under
+// its own dirSnapMu, once c.mu has been released.
+func (c *dirSnapshotCache) touch(fid *ufsFid) {
+	c.mu.Lock()
+
+	if e, ok := c.elems[fid]; ok {
+		c.ll.MoveToFront(e)
+		c.mu.Unlock()
+		return
+	}
+
+	c.elems[fid] = c.ll.PushFront(fid)
+
+	var victims []*ufsFid
+	for c.ll.Len() > c.cap {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		of := oldest.Value.(*ufsFid)
+		victims = append(victims, of)
+		c.ll.Remove(oldest)
+		delete(c.elems, of)
+	}
+
+	c.mu.Unlock()
+
+	for _, of := range victims {
+		if of == fid {
+			// Caller already holds fid.dirSnapMu; it was just
+			// inserted above, so this only happens with cap <= 0.
+			of.dirSnap = nil
+			continue
+		}
+		of.dirSnapMu.Lock()
+		of.dirSnap = nil
+		of.dirSnapMu.Unlock()
+	}
+}
+
+// forget drops fid from the cache outright, for when the fid itself is
+// being destroyed rather than merely aged out.
+func (c *dirSnapshotCache) forget(fid *ufsFid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.elems[fid]; ok {
+		c.ll.Remove(e)
+		delete(c.elems, fid)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import "context"
+
+// FsNode is an opaque per-fid handle a Filesystem hands back from Root,
+// Walk and Create. Only the Filesystem that issued it knows what's inside;
+// callers just thread it back into later calls on the same fid.
+type FsNode interface{}
+
+// Filesystem is the backend the legacy (non-.L) Ufs handlers drive. Ufs
+// itself only speaks the 9P wire protocol: fid bookkeeping, Tversion/Tauth
+// negotiation and packing Rerror/Rstat/etc; every actual filesystem
+// side-effect goes through here. LocalFS is the on-disk implementation
+// Ufs defaults to; a caller can set Ufs.FS to something else (an
+// in-memory tree, an overlay, a store backed by S3, a test double) to
+// reuse the whole 9P state machine without reimplementing it.
+//
+// The .L dialect handlers (ufs_dotl.go) and the xattr handlers
+// (ufs_xattr.go) are not routed through Filesystem: they depend on
+// Linux/Darwin-only operations (openat, symlinkat, xattrs, POSIX locks)
+// that don't generalize across arbitrary backends, so they keep working
+// directly against the concrete *ufsFid LocalFS produces.
+type Filesystem interface {
+	// Root resolves aname (already trimmed of leading/trailing slashes
+	// is not guaranteed; implementations should accept "a/b/c" style
+	// paths) against the filesystem root and returns the node a newly
+	// attached fid should hold, plus its qid.
+	Root(ctx context.Context, aname string) (FsNode, Qid, error)
+
+	// Walk resolves names in sequence starting at dir. It returns the
+	// node of the last component it managed to resolve and the qid of
+	// every resolved component; err explains why it stopped short of
+	// len(names), if it did. A zero-length names walks to a clone of
+	// dir.
+	Walk(ctx context.Context, dir FsNode, names []string) (FsNode, []Qid, error)
+
+	// Open prepares node for ReadAt/WriteAt/Readdir according to the 9P
+	// open mode byte (OREAD/OWRITE/ORDWR/OEXEC, optionally OTRUNC).
+	Open(ctx context.Context, node FsNode, mode uint8) (Qid, error)
+
+	// Create makes name inside dir and opens it per mode. link is
+	// non-nil when perm has DMLINK set, naming the node to hard-link
+	// to; ext carries the symlink target when perm has DMSYMLINK set.
+	// dotu controls whether DMSETUID/DMSETGID are honored. dir is
+	// consumed: on success it is no longer valid and the returned node
+	// takes its place on the fid, exactly as a Tcreate fid morphs into
+	// the file it just created.
+	Create(ctx context.Context, dir FsNode, name string, perm uint32, mode uint8, ext string, link FsNode, dotu bool) (FsNode, Qid, error)
+
+	ReadAt(ctx context.Context, node FsNode, p []byte, offset int64) (int, error)
+	WriteAt(ctx context.Context, node FsNode, p []byte, offset int64) (int, error)
+
+	// Readdir packs as many directory entries as fit into buf, starting
+	// at offset, using the same wire format PackDir produces. It is
+	// expected to behave like repeated Tread calls on a directory fid:
+	// offset 0 (re)starts the listing, and a non-zero offset continues
+	// from wherever the previous call left off.
+	Readdir(ctx context.Context, node FsNode, offset uint64, buf []byte, dotu bool, upool Users) (int, error)
+
+	Remove(ctx context.Context, node FsNode) error
+	Stat(ctx context.Context, node FsNode, dotu bool, upool Users) (*Dir, error)
+	Wstat(ctx context.Context, node FsNode, dir *Dir, dotu bool) error
+}
@@ -0,0 +1,210 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"context"
+	"testing"
+)
+
+// fsUnderTest returns the Filesystem implementations these tests run
+// against. Every case below runs once per entry, so a behavior the
+// Filesystem interface promises has to hold for LocalFS (the disk-backed
+// implementation Ufs defaults to) and MemFS (the in-memory reference
+// implementation) alike; that's the whole point of the interface.
+func fsUnderTest(t *testing.T) map[string]Filesystem {
+	return map[string]Filesystem{
+		"LocalFS": &LocalFS{Root: t.TempDir()},
+		"MemFS":   &MemFS{},
+	}
+}
+
+// mkfile creates name inside dir with perm and, if data is non-empty,
+// writes it through the node Create returned, which it then returns.
+// Create consumes the node it is given, so mkfile hands it a zero-length
+// Walk clone of dir and dir itself stays usable by the caller.
+func mkfile(t *testing.T, ctx context.Context, fs Filesystem, dir FsNode, name string, perm uint32, data []byte) FsNode {
+	t.Helper()
+
+	parent, _, err := fs.Walk(ctx, dir, nil)
+	if err != nil {
+		t.Fatalf("Walk(clone of dir): %v", err)
+	}
+
+	node, _, err := fs.Create(ctx, parent, name, perm, OWRITE, "", nil, false)
+	if err != nil {
+		t.Fatalf("Create(%q): %v", name, err)
+	}
+	if len(data) > 0 {
+		if _, err := fs.WriteAt(ctx, node, data, 0); err != nil {
+			t.Fatalf("WriteAt(%q): %v", name, err)
+		}
+	}
+	return node
+}
+
+func TestFilesystemCreateReadWrite(t *testing.T) {
+	ctx := context.Background()
+
+	for name, fs := range fsUnderTest(t) {
+		t.Run(name, func(t *testing.T) {
+			root, _, err := fs.Root(ctx, "")
+			if err != nil {
+				t.Fatalf("Root: %v", err)
+			}
+
+			want := []byte("hello, 9p")
+			mkfile(t, ctx, fs, root, "greeting", 0644, want)
+
+			node, qids, err := fs.Walk(ctx, root, []string{"greeting"})
+			if err != nil {
+				t.Fatalf("Walk: %v", err)
+			}
+			if len(qids) != 1 {
+				t.Fatalf("Walk returned %d qids, want 1", len(qids))
+			}
+
+			if _, err := fs.Open(ctx, node, OREAD); err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+
+			got := make([]byte, len(want))
+			n, err := fs.ReadAt(ctx, node, got, 0)
+			if err != nil {
+				t.Fatalf("ReadAt: %v", err)
+			}
+			if n != len(want) || string(got) != string(want) {
+				t.Fatalf("ReadAt = %q, want %q", got[:n], want)
+			}
+
+			dir, err := fs.Stat(ctx, node, false, nil)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if dir.Name != "greeting" {
+				t.Fatalf("Stat.Name = %q, want %q", dir.Name, "greeting")
+			}
+			if dir.Length != uint64(len(want)) {
+				t.Fatalf("Stat.Length = %d, want %d", dir.Length, len(want))
+			}
+		})
+	}
+}
+
+func TestFilesystemWalkMissing(t *testing.T) {
+	ctx := context.Background()
+
+	for name, fs := range fsUnderTest(t) {
+		t.Run(name, func(t *testing.T) {
+			root, _, err := fs.Root(ctx, "")
+			if err != nil {
+				t.Fatalf("Root: %v", err)
+			}
+
+			if _, _, err := fs.Walk(ctx, root, []string{"nope"}); err == nil {
+				t.Fatal("Walk of a nonexistent name succeeded, want an error")
+			}
+		})
+	}
+}
+
+// TestFilesystemReaddirPaging exercises Readdir the way a client actually
+// drives it: repeated calls with a deliberately small buf, each resuming
+// from the offset the previous call left off at. It checks two things a
+// Readdir that slices its packed listing at a raw byte boundary (rather
+// than stopping before a record that wouldn't fit whole) can get wrong:
+// it must never hand back more bytes than buf can hold, and paging
+// through in small steps must total exactly as many bytes as one call
+// with a buffer big enough for the whole listing returns.
+func TestFilesystemReaddirPaging(t *testing.T) {
+	ctx := context.Background()
+
+	for name, fs := range fsUnderTest(t) {
+		t.Run(name, func(t *testing.T) {
+			root, _, err := fs.Root(ctx, "")
+			if err != nil {
+				t.Fatalf("Root: %v", err)
+			}
+
+			const n = 64
+			for i := 0; i < n; i++ {
+				mkfile(t, ctx, fs, root, "entry"+itoa(i), 0644, nil)
+			}
+
+			whole := make([]byte, 1<<20)
+			want, err := fs.Readdir(ctx, root, 0, whole, false, nil)
+			if err != nil {
+				t.Fatalf("Readdir (whole): %v", err)
+			}
+
+			small := make([]byte, 97) // odd size, unlikely to land on a record boundary by luck
+			var offset uint64
+			var total int
+			for {
+				m, err := fs.Readdir(ctx, root, offset, small, false, nil)
+				if err != nil {
+					t.Fatalf("Readdir at offset %d: %v", offset, err)
+				}
+				if m > len(small) {
+					t.Fatalf("Readdir wrote %d bytes into a %d-byte buf", m, len(small))
+				}
+				if m == 0 {
+					break
+				}
+				total += m
+				offset += uint64(m)
+			}
+
+			if total != want {
+				t.Fatalf("paged Readdir totaled %d bytes, want %d (single-call result)", total, want)
+			}
+		})
+	}
+}
+
+func TestFilesystemRemove(t *testing.T) {
+	ctx := context.Background()
+
+	for name, fs := range fsUnderTest(t) {
+		t.Run(name, func(t *testing.T) {
+			root, _, err := fs.Root(ctx, "")
+			if err != nil {
+				t.Fatalf("Root: %v", err)
+			}
+
+			node := mkfile(t, ctx, fs, root, "todelete", 0644, nil)
+			if err := fs.Remove(ctx, node); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+
+			if _, _, err := fs.Walk(ctx, root, []string{"todelete"}); err == nil {
+				t.Fatal("Walk found a file after Remove, want an error")
+			}
+		})
+	}
+}
+
+// itoa avoids importing strconv just for this one call site.
+func itoa(i int) string {
+	if i == 0 {
+		return "0"
+	}
+	var buf [20]byte
+	pos := len(buf)
+	neg := i < 0
+	if neg {
+		i = -i
+	}
+	for i > 0 {
+		pos--
+		buf[pos] = byte('0' + i%10)
+		i /= 10
+	}
+	if neg {
+		pos--
+		buf[pos] = '-'
+	}
+	return string(buf[pos:])
+}
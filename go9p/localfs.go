@@ -0,0 +1,500 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LocalFS is the Filesystem Ufs defaults to: it serves a real directory
+// tree, sandboxed against Root via the dirfd/O_PATH scheme ufsFid
+// documents. It is the implementation this package has always shipped;
+// the Filesystem interface just gives it a name a caller can swap out.
+type LocalFS struct {
+	// Root is the filesystem path this LocalFS serves. It is opened
+	// once, on first use, and becomes the anchor dirfd every fid
+	// descends from. Falls back to the -root flag when empty.
+	Root string
+
+	// FollowSymlinks restores the pre-sandboxing behaviour of resolving
+	// a symlink component against the real filesystem. Off by default:
+	// a client cannot otherwise escape Root by walking through a
+	// symlink planted inside the served tree. Also settable via the
+	// -follow-symlinks flag.
+	FollowSymlinks bool
+
+	// StreamDirs skips directory snapshotting (see dirSnapshot) in
+	// favor of the old cursor-based Readdir, which never holds more
+	// than 16 entries in memory at once. Snapshotting a directory with
+	// millions of entries is the wrong tradeoff; set this (or the
+	// -stream-dirs flag) to serve those, at the cost of only supporting
+	// sequential reads per fid. Off by default.
+	StreamDirs bool
+
+	// DirSnapshotCap bounds how many directory fids' snapshots
+	// dirSnapshotCache keeps alive at once; least-recently-read ones
+	// are discarded (and rebuilt on demand) once the cap is exceeded.
+	// Defaults to defaultDirSnapshotCap.
+	DirSnapshotCap int
+
+	rootOnce sync.Once
+	rootfd   *os.File
+	rootErr  error
+
+	dirCacheOnce sync.Once
+	dirCache     *dirSnapshotCache
+}
+
+// defaultDirSnapshotCap is DirSnapshotCap's default.
+const defaultDirSnapshotCap = 1024
+
+func (fs *LocalFS) dirSnapshotCache() *dirSnapshotCache {
+	fs.dirCacheOnce.Do(func() {
+		cap := fs.DirSnapshotCap
+		if cap <= 0 {
+			cap = defaultDirSnapshotCap
+		}
+		fs.dirCache = newDirSnapshotCache(cap)
+	})
+	return fs.dirCache
+}
+
+func (fs *LocalFS) streamDirs() bool {
+	return fs.StreamDirs || *streamDirsFlag
+}
+
+// root returns the anchor dirfd for the tree this LocalFS serves, opening
+// it the first time it's needed.
+func (fs *LocalFS) root() (*os.File, error) {
+	fs.rootOnce.Do(func() {
+		path := fs.Root
+		if path == "" {
+			path = *root
+		}
+		fs.rootfd, fs.rootErr = os.Open(path)
+	})
+	return fs.rootfd, fs.rootErr
+}
+
+func (fs *LocalFS) followSymlinks() bool {
+	return fs.FollowSymlinks || *followSymlinksFlag
+}
+
+// statNode is fid.stat() without the *Error wrapping, for callers (like
+// LocalFS's own methods) that need to satisfy the plain-error Filesystem
+// contract.
+func statNode(fid *ufsFid) error {
+	st, err := fid.dirfd.Stat()
+	if err != nil {
+		return err
+	}
+	fid.st = st
+	return nil
+}
+
+func (fs *LocalFS) Root(ctx context.Context, aname string) (FsNode, Qid, error) {
+	rootfd, err := fs.root()
+	if err != nil {
+		return nil, Qid{}, err
+	}
+
+	var names []string
+	if a := strings.Trim(aname, "/"); a != "" {
+		names = strings.Split(a, "/")
+	}
+
+	parent, cur, _, werr := walkPath(rootfd, names, fs.followSymlinks())
+	if werr != nil {
+		if cur != nil {
+			cur.Close()
+		}
+		if parent != nil {
+			parent.Close()
+		}
+		return nil, Qid{}, werr
+	}
+
+	fid := &ufsFid{dirfd: cur, parent: parent}
+	if len(names) > 0 {
+		fid.name = names[len(names)-1]
+	}
+	if err := statNode(fid); err != nil {
+		return nil, Qid{}, err
+	}
+
+	return fid, *dir2Qid(fid.st), nil
+}
+
+func (fs *LocalFS) Walk(ctx context.Context, dir FsNode, names []string) (FsNode, []Qid, error) {
+	fid := dir.(*ufsFid)
+
+	parent, cur, qids, werr := walkPath(fid.dirfd, names, fs.followSymlinks())
+	if werr != nil && len(qids) == 0 && len(names) > 0 {
+		cur.Close()
+		if parent != nil {
+			parent.Close()
+		}
+		return nil, nil, werr
+	}
+
+	nfid := &ufsFid{dirfd: cur, parent: parent}
+	if len(qids) > 0 {
+		nfid.name = names[len(qids)-1]
+	} else {
+		nfid.name = fid.name
+	}
+
+	return nfid, qids, werr
+}
+
+func (fs *LocalFS) Open(ctx context.Context, node FsNode, mode uint8) (Qid, error) {
+	fid := node.(*ufsFid)
+	if err := statNode(fid); err != nil {
+		return Qid{}, err
+	}
+
+	f, err := fid.open(omode2uflags(mode))
+	if err != nil {
+		return Qid{}, err
+	}
+	fid.file = f
+
+	return *dir2Qid(fid.st), nil
+}
+
+func (fs *LocalFS) Create(ctx context.Context, dir FsNode, name string, perm uint32, mode uint8, ext string, link FsNode, dotu bool) (FsNode, Qid, error) {
+	fid := dir.(*ufsFid)
+	if err := statNode(fid); err != nil {
+		return nil, Qid{}, err
+	}
+
+	if name == ".." || strings.Contains(name, "/") {
+		return nil, Qid{}, syscall.EINVAL
+	}
+
+	dirfd := int(fid.dirfd.Fd())
+	var e error
+	var file *os.File
+
+	switch {
+	case perm&DMDIR != 0:
+		e = unix.Mkdirat(dirfd, name, perm&0777)
+
+	case perm&DMSYMLINK != 0:
+		e = unix.Symlinkat(ext, dirfd, name)
+
+	case perm&DMLINK != 0:
+		if link == nil {
+			return nil, Qid{}, syscall.EINVAL
+		}
+		lfid := link.(*ufsFid)
+		e = unix.Linkat(int(lfid.dirfd.Fd()), "", dirfd, name, unix.AT_EMPTY_PATH)
+
+	case perm&DMNAMEDPIPE != 0, perm&DMDEVICE != 0:
+		return nil, Qid{}, syscall.ENOSYS
+
+	default:
+		m := perm & 0777
+		if dotu {
+			if perm&DMSETUID > 0 {
+				m |= syscall.S_ISUID
+			}
+			if perm&DMSETGID > 0 {
+				m |= syscall.S_ISGID
+			}
+		}
+		var fd int
+		fd, e = unix.Openat(dirfd, name, omode2uflags(mode)|unix.O_CREAT, m)
+		if e == nil {
+			file = os.NewFile(uintptr(fd), name)
+		}
+	}
+
+	if e != nil {
+		return nil, Qid{}, e
+	}
+
+	child, werr := walkOne(fid.dirfd, name, false)
+	if werr != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, Qid{}, werr
+	}
+
+	pdup, derr := dupFd(fid.dirfd)
+	if derr != nil {
+		child.Close()
+		if file != nil {
+			file.Close()
+		}
+		return nil, Qid{}, derr
+	}
+
+	nfid := &ufsFid{dirfd: child, parent: pdup, name: name, file: file}
+	if err := statNode(nfid); err != nil {
+		return nil, Qid{}, err
+	}
+
+	fid.dirfd.Close()
+	if fid.parent != nil {
+		fid.parent.Close()
+	}
+
+	return nfid, *dir2Qid(nfid.st), nil
+}
+
+func (fs *LocalFS) ReadAt(ctx context.Context, node FsNode, p []byte, offset int64) (int, error) {
+	return node.(*ufsFid).file.ReadAt(p, offset)
+}
+
+func (fs *LocalFS) WriteAt(ctx context.Context, node FsNode, p []byte, offset int64) (int, error) {
+	return node.(*ufsFid).file.WriteAt(p, offset)
+}
+
+func (fs *LocalFS) Readdir(ctx context.Context, node FsNode, offset uint64, buf []byte, dotu bool, upool Users) (int, error) {
+	fid := node.(*ufsFid)
+
+	if fs.streamDirs() {
+		return fs.readdirStream(fid, offset, buf, dotu, upool)
+	}
+
+	snap, err := fs.dirSnapshotFor(fid, dotu, upool)
+	if err != nil {
+		return 0, err
+	}
+
+	return snap.readAt(offset, buf, dotu), nil
+}
+
+// dirSnapshotFor returns fid's directory snapshot, building it on first
+// use (or after it's been evicted by the LRU since), and marks fid as
+// recently read. Offset plays no part here: unlike the old fid.dirs
+// cursor, the snapshot serves any offset equally, which is the whole
+// point. fid.dirSnapMu makes this safe against parallel Treads on the
+// same fid racing to build it, and against the LRU evicting it (under
+// dirSnapshotCache's own mutex) concurrently with either.
+func (fs *LocalFS) dirSnapshotFor(fid *ufsFid, dotu bool, upool Users) (*dirSnapshot, error) {
+	fid.dirSnapMu.Lock()
+	defer fid.dirSnapMu.Unlock()
+
+	if fid.dirSnap == nil {
+		snap, err := fs.buildDirSnapshot(fid, dotu, upool)
+		if err != nil {
+			return nil, err
+		}
+		fid.dirSnap = snap
+	}
+
+	fs.dirSnapshotCache().touch(fid)
+	return fid.dirSnap, nil
+}
+
+func (fs *LocalFS) buildDirSnapshot(fid *ufsFid, dotu bool, upool Users) (*dirSnapshot, error) {
+	f, err := fid.open(omode2uflags(OREAD))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	infos, err := f.Readdir(-1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	dirfd := int(fid.dirfd.Fd())
+	return newDirSnapshot(infos, dotu, upool, func(name string) (string, error) {
+		return readlinkAt(dirfd, name)
+	}), nil
+}
+
+// readdirStream is the pre-snapshot implementation, kept for
+// LocalFS.StreamDirs/-stream-dirs: it never holds more than 16 entries in
+// memory, at the cost of only supporting sequential reads per fid and
+// treating offset 0 as "restart the listing".
+func (fs *LocalFS) readdirStream(fid *ufsFid, offset uint64, buf []byte, dotu bool, upool Users) (int, error) {
+	if offset == 0 {
+		if fid.file != nil {
+			fid.file.Close()
+		}
+		f, err := fid.open(omode2uflags(OREAD))
+		if err != nil {
+			return 0, err
+		}
+		fid.file = f
+		fid.dirs = nil
+	}
+
+	var count int
+	b := buf
+
+	for len(b) > 0 {
+		if fid.dirs == nil {
+			infos, e := fid.file.Readdir(16)
+			if e != nil && e != io.EOF {
+				return count, e
+			}
+			fid.dirs = infos
+			if len(fid.dirs) == 0 {
+				break
+			}
+		}
+
+		dirfd := int(fid.dirfd.Fd())
+		var i int
+		for i = 0; i < len(fid.dirs); i++ {
+			entry := fid.dirs[i]
+			name := entry.Name()
+			d := dir2Dir(name, entry, dotu, upool, func() (string, error) {
+				return readlinkAt(dirfd, name)
+			})
+			sz := PackDir(d, b, dotu)
+			if sz == 0 {
+				break
+			}
+			b = b[sz:]
+			count += sz
+		}
+
+		if i < len(fid.dirs) {
+			fid.dirs = fid.dirs[i:]
+			break
+		}
+		fid.dirs = nil
+	}
+
+	return count, nil
+}
+
+func (fs *LocalFS) Remove(ctx context.Context, node FsNode) error {
+	fid := node.(*ufsFid)
+	if err := statNode(fid); err != nil {
+		return err
+	}
+
+	if fid.parent == nil {
+		return syscall.EBUSY
+	}
+
+	flags := 0
+	if fid.st.IsDir() {
+		flags = unix.AT_REMOVEDIR
+	}
+
+	return unix.Unlinkat(int(fid.parent.Fd()), fid.name, flags)
+}
+
+func (fs *LocalFS) Stat(ctx context.Context, node FsNode, dotu bool, upool Users) (*Dir, error) {
+	fid := node.(*ufsFid)
+	if err := statNode(fid); err != nil {
+		return nil, err
+	}
+
+	dirfd := int(fid.dirfd.Fd())
+	return dir2Dir(fid.name, fid.st, dotu, upool, func() (string, error) {
+		return readlinkAt(dirfd, "")
+	}), nil
+}
+
+func (fs *LocalFS) Wstat(ctx context.Context, node FsNode, dir *Dir, dotu bool) error {
+	fid := node.(*ufsFid)
+	if err := statNode(fid); err != nil {
+		return err
+	}
+
+	procPath := fid.procPath()
+
+	if dir.Mode != 0xFFFFFFFF {
+		mode := dir.Mode & 0777
+		if dotu {
+			if dir.Mode&DMSETUID > 0 {
+				mode |= syscall.S_ISUID
+			}
+			if dir.Mode&DMSETGID > 0 {
+				mode |= syscall.S_ISGID
+			}
+		}
+		if e := os.Chmod(procPath, os.FileMode(mode)); e != nil {
+			return e
+		}
+	}
+
+	uid, gid := NOUID, NOUID
+	if dotu {
+		uid = dir.Uidnum
+		gid = dir.Gidnum
+	}
+
+	// Try to find local uid, gid by name.
+	if (dir.Uid != "" || dir.Gid != "") && !dotu {
+		var lerr *Error
+		if uid, lerr = lookup(dir.Uid, false); lerr != nil {
+			return lerr
+		}
+
+		// BUG(akumar): Lookup will never find gids
+		// corresponding to group names, because
+		// it only operates on user names.
+		if gid, lerr = lookup(dir.Gid, true); lerr != nil {
+			return lerr
+		}
+	}
+
+	if uid != NOUID || gid != NOUID {
+		if e := os.Chown(procPath, int(uid), int(gid)); e != nil {
+			return e
+		}
+	}
+
+	if dir.Name != "" && dir.Name != fid.name {
+		if fid.parent == nil {
+			return syscall.EBUSY
+		}
+
+		if e := unix.Renameat(int(fid.parent.Fd()), fid.name, int(fid.parent.Fd()), dir.Name); e != nil {
+			return e
+		}
+		fid.name = dir.Name
+	}
+
+	if dir.Length != 0xFFFFFFFFFFFFFFFF {
+		if e := os.Truncate(procPath, int64(dir.Length)); e != nil {
+			return e
+		}
+	}
+
+	// Atime and mtime are independent: a client leaving one of them at
+	// ^uint32(0) ("don't touch") must not clobber the other, so we go
+	// through UtimesNanoAt with UTIME_OMIT on whichever axis is unset
+	// rather than Chtimes, which always sets both.
+	if dir.Mtime != ^uint32(0) || dir.Atime != ^uint32(0) {
+		ts := [2]unix.Timespec{omitTimespec(), omitTimespec()}
+		if dir.Atime != ^uint32(0) {
+			ts[0] = unix.NsecToTimespec(time.Unix(int64(dir.Atime), 0).UnixNano())
+		}
+		if dir.Mtime != ^uint32(0) {
+			ts[1] = unix.NsecToTimespec(time.Unix(int64(dir.Mtime), 0).UnixNano())
+		}
+		if e := unix.UtimesNanoAt(unix.AT_FDCWD, procPath, ts[:], 0); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// omitTimespec is the UTIME_OMIT sentinel for UtimesNanoAt: "leave this
+// timestamp alone".
+func omitTimespec() unix.Timespec {
+	return unix.Timespec{Sec: 0, Nsec: unix.UTIME_OMIT}
+}
@@ -0,0 +1,355 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memNode is a file or directory in a MemFS tree.
+type memNode struct {
+	mu sync.Mutex
+
+	name     string
+	dir      bool
+	mode     uint32
+	symlink  string
+	data     []byte
+	mtime    time.Time
+	parent   *memNode
+	children map[string]*memNode
+
+	qidPath uint64
+	version uint32
+}
+
+func (n *memNode) qid() Qid {
+	var t uint8
+	if n.dir {
+		t |= QTDIR
+	}
+	if n.symlink != "" {
+		t |= QTSYMLINK
+	}
+	return Qid{Path: n.qidPath, Version: n.version, Type: t}
+}
+
+// dir2Dir builds the wire Dir for n, the memNode analogue of the
+// disk-backed dir2Dir in ufs.go.
+func (n *memNode) dir2Dir(dotu bool, upool Users) *Dir {
+	mode := n.mode
+	if n.dir {
+		mode |= DMDIR
+	}
+
+	d := &Dir{
+		Qid:    n.qid(),
+		Mode:   mode,
+		Atime:  uint32(n.mtime.Unix()),
+		Mtime:  uint32(n.mtime.Unix()),
+		Length: uint64(len(n.data)),
+		Name:   n.name,
+	}
+
+	if !dotu {
+		d.Uid, d.Gid, d.Muid = "none", "none", "none"
+		return d
+	}
+
+	if n.symlink != "" {
+		mode |= DMSYMLINK
+	}
+	u := upool.Uid2User(0)
+	g := upool.Gid2Group(0)
+	d.Uid, d.Gid, d.Muid = u.Name(), g.Name(), "none"
+	if d.Uid == "" {
+		d.Uid = "none"
+	}
+	if d.Gid == "" {
+		d.Gid = "none"
+	}
+	d.Uidnum, d.Gidnum, d.Muidnum = uint32(u.Id()), uint32(g.Id()), NOUID
+	d.Ext = n.symlink
+	d.Mode = mode
+
+	return d
+}
+
+func (n *memNode) child(name string) (*memNode, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.dir {
+		return nil, syscall.ENOTDIR
+	}
+	c, ok := n.children[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return c, nil
+}
+
+// MemFS is an in-memory Filesystem: the reference implementation the
+// Filesystem interface was designed against, and a demonstration that
+// Ufs's legacy handlers need nothing from LocalFS's dirfd/O_PATH scheme.
+// It's handy for tests, or for serving a throwaway tree without touching
+// disk. A zero MemFS is ready to use; its root directory is created on
+// first call.
+type MemFS struct {
+	once sync.Once
+	root *memNode
+
+	qidMu   sync.Mutex
+	nextQid uint64
+}
+
+func (fs *MemFS) init() {
+	fs.once.Do(func() {
+		fs.root = &memNode{
+			name:     "/",
+			dir:      true,
+			mode:     0755,
+			mtime:    time.Now(),
+			children: map[string]*memNode{},
+			qidPath:  fs.allocQid(),
+		}
+	})
+}
+
+func (fs *MemFS) allocQid() uint64 {
+	fs.qidMu.Lock()
+	defer fs.qidMu.Unlock()
+	fs.nextQid++
+	return fs.nextQid
+}
+
+func (fs *MemFS) Root(ctx context.Context, aname string) (FsNode, Qid, error) {
+	fs.init()
+
+	n := fs.root
+	if a := strings.Trim(aname, "/"); a != "" {
+		for _, name := range strings.Split(a, "/") {
+			c, err := n.child(name)
+			if err != nil {
+				return nil, Qid{}, err
+			}
+			n = c
+		}
+	}
+
+	return n, n.qid(), nil
+}
+
+func (fs *MemFS) Walk(ctx context.Context, dir FsNode, names []string) (FsNode, []Qid, error) {
+	n := dir.(*memNode)
+	qids := make([]Qid, 0, len(names))
+
+	for _, name := range names {
+		c, err := n.child(name)
+		if err != nil {
+			return n, qids, err
+		}
+		n = c
+		qids = append(qids, n.qid())
+	}
+
+	return n, qids, nil
+}
+
+func (fs *MemFS) Open(ctx context.Context, node FsNode, mode uint8) (Qid, error) {
+	n := node.(*memNode)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if mode&OTRUNC != 0 && !n.dir {
+		n.data = nil
+		n.version++
+	}
+
+	return n.qid(), nil
+}
+
+func (fs *MemFS) Create(ctx context.Context, dir FsNode, name string, perm uint32, mode uint8, ext string, link FsNode, dotu bool) (FsNode, Qid, error) {
+	n := dir.(*memNode)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.dir {
+		return nil, Qid{}, syscall.ENOTDIR
+	}
+	if _, exists := n.children[name]; exists {
+		return nil, Qid{}, syscall.EEXIST
+	}
+
+	if perm&DMLINK != 0 {
+		if link == nil {
+			return nil, Qid{}, syscall.EINVAL
+		}
+		lnode := link.(*memNode)
+		n.children[name] = lnode
+		return lnode, lnode.qid(), nil
+	}
+
+	if perm&DMNAMEDPIPE != 0 || perm&DMDEVICE != 0 {
+		return nil, Qid{}, syscall.ENOSYS
+	}
+
+	child := &memNode{
+		name:    name,
+		parent:  n,
+		mode:    perm & 0777,
+		mtime:   time.Now(),
+		qidPath: fs.allocQid(),
+	}
+
+	switch {
+	case perm&DMDIR != 0:
+		child.dir = true
+		child.children = map[string]*memNode{}
+	case perm&DMSYMLINK != 0:
+		child.symlink = ext
+	}
+
+	n.children[name] = child
+	return child, child.qid(), nil
+}
+
+func (fs *MemFS) ReadAt(ctx context.Context, node FsNode, p []byte, offset int64) (int, error) {
+	n := node.(*memNode)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if offset >= int64(len(n.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, n.data[offset:]), nil
+}
+
+func (fs *MemFS) WriteAt(ctx context.Context, node FsNode, p []byte, offset int64) (int, error) {
+	n := node.(*memNode)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	end := offset + int64(len(p))
+	if end > int64(len(n.data)) {
+		grown := make([]byte, end)
+		copy(grown, n.data)
+		n.data = grown
+	}
+	copy(n.data[offset:end], p)
+	n.mtime = time.Now()
+	n.version++
+
+	return len(p), nil
+}
+
+// Readdir rebuilds n's listing fresh on every call and packs it into buf
+// one entry at a time via a throwaway dirSnapshot, stopping short of any
+// entry that wouldn't fit whole. That's wasteful for a huge directory
+// compared to LocalFS's cached snapshot, but MemFS has no persistent
+// directory-fd cursor to resume, and correctness is the point of a
+// reference implementation, not speed. Packing a raw byte range instead
+// would risk handing back half of a Dir record when the listing outgrows
+// one read's buf, corrupting the next offset.
+func (fs *MemFS) Readdir(ctx context.Context, node FsNode, offset uint64, buf []byte, dotu bool, upool Users) (int, error) {
+	n := node.(*memNode)
+
+	n.mu.Lock()
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	children := make([]*memNode, len(names))
+	for i, name := range names {
+		children[i] = n.children[name]
+	}
+	n.mu.Unlock()
+
+	dirs := make([]*Dir, len(children))
+	for i, c := range children {
+		c.mu.Lock()
+		dirs[i] = c.dir2Dir(dotu, upool)
+		c.mu.Unlock()
+	}
+
+	snap := newDirSnapshotFromDirs(dirs, dotu)
+	return snap.readAt(offset, buf, dotu), nil
+}
+
+func (fs *MemFS) Remove(ctx context.Context, node FsNode) error {
+	n := node.(*memNode)
+	if n.parent == nil {
+		return syscall.EBUSY
+	}
+
+	n.parent.mu.Lock()
+	defer n.parent.mu.Unlock()
+
+	if n.dir && len(n.children) > 0 {
+		return syscall.ENOTEMPTY
+	}
+
+	delete(n.parent.children, n.name)
+	return nil
+}
+
+func (fs *MemFS) Stat(ctx context.Context, node FsNode, dotu bool, upool Users) (*Dir, error) {
+	n := node.(*memNode)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.dir2Dir(dotu, upool), nil
+}
+
+func (fs *MemFS) Wstat(ctx context.Context, node FsNode, dir *Dir, dotu bool) error {
+	n := node.(*memNode)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if dir.Mode != 0xFFFFFFFF {
+		n.mode = dir.Mode & 0777
+	}
+
+	if dir.Name != "" && dir.Name != n.name {
+		if n.parent == nil {
+			return syscall.EBUSY
+		}
+
+		n.parent.mu.Lock()
+		if _, exists := n.parent.children[dir.Name]; exists {
+			n.parent.mu.Unlock()
+			return syscall.EEXIST
+		}
+		delete(n.parent.children, n.name)
+		n.parent.children[dir.Name] = n
+		n.parent.mu.Unlock()
+		n.name = dir.Name
+	}
+
+	if dir.Length != 0xFFFFFFFFFFFFFFFF && !n.dir {
+		size := int(dir.Length)
+		if size <= len(n.data) {
+			n.data = n.data[:size]
+		} else {
+			grown := make([]byte, size)
+			copy(grown, n.data)
+			n.data = grown
+		}
+	}
+
+	if dir.Mtime != ^uint32(0) {
+		n.mtime = time.Unix(int64(dir.Mtime), 0)
+	}
+
+	n.version++
+	return nil
+}
@@ -5,6 +5,7 @@
 package go9p
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -13,27 +14,126 @@ import (
 	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
-	"time"
+
+	"golang.org/x/sys/unix"
 )
 
+// ufsFid anchors a fid to the filesystem via O_PATH file descriptors rather
+// than a path string: dirfd is this fid's own node, parent is the directory
+// it was resolved out of (nil only for the attach root), and name is its
+// entry name within parent. Every descendant fid is reached by an openat
+// relative to some ancestor's dirfd, so a client can never name its way
+// outside the tree Ufs.Root anchors.
 type ufsFid struct {
-	path      string
-	file      *os.File
-	dirs      []os.FileInfo
-	diroffset uint64
-	st        os.FileInfo
+	dirfd  *os.File
+	parent *os.File
+	name   string
+	file   *os.File
+	st     os.FileInfo
+
+	// dirs is only used in LocalFS's streaming-readdir mode (see
+	// LocalFS.StreamDirs); snapshot mode builds dirSnap instead and
+	// never touches this.
+	dirs []os.FileInfo
+
+	// dirSnap is this fid's directory-listing snapshot, built lazily on
+	// first Tread/Treaddir and served from (via binary search on
+	// offset/cookie) for the rest of the fid's life, or until
+	// LocalFS's snapshot LRU evicts it. nil for non-directory fids and
+	// for directory fids that haven't been read yet. dirSnapMu guards
+	// both fields: parallel Treads on the same fid can race to build it,
+	// and the LRU can evict it (setting it back to nil) concurrently
+	// with either.
+	dirSnapMu sync.Mutex
+	dirSnap   *dirSnapshot
+
+	// xattrMode is non-zero once a Txattrwalk/Txattrcreate has put this
+	// fid in xattr mode, at which point Read/Write/Clunk stop operating
+	// on file data and start operating on xattrBuf instead.
+	xattrMode  uint8
+	xattrName  string
+	xattrBuf   []byte
+	xattrFlags uint32
+}
+
+// xattrMode values for ufsFid.xattrMode.
+const (
+	xattrNone = iota
+	xattrRead
+	xattrWrite
+)
+
+// procPath returns the magic /proc/self/fd symlink for fid's own node,
+// which the kernel resolves straight to the underlying inode without
+// re-walking any path component. It lets Wstat/Setattr reuse path-based
+// calls (os.Chmod, os.Chown, os.Truncate, unix.Fchmodat, unix.UtimesNanoAt)
+// instead of hand-rolling
+// fchmod/fchown/ftruncate/futimens wrappers for a non-O_PATH-friendly fd.
+func (fid *ufsFid) procPath() string {
+	return procPathFor(fid.dirfd)
+}
+
+// procPathFor is procPath for an arbitrary O_PATH handle, for callers (like
+// Xattrwalk) that haven't necessarily wrapped it in a ufsFid yet.
+func procPathFor(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// open reopens fid's node with real (non-O_PATH) flags, going through the
+// /proc/self/fd magic link so the open doesn't have to re-walk fid.name
+// against fid.parent (and couldn't anyway once fid.parent is gone).
+func (fid *ufsFid) open(flags int) (*os.File, error) {
+	return os.OpenFile(fid.procPath(), flags, 0)
 }
 
 type Ufs struct {
 	Srv
+
+	// Root is the filesystem path this Ufs serves, passed through to FS
+	// when FS is left nil. Falls back to the -root flag when empty.
+	Root string
+
+	// FollowSymlinks restores the pre-sandboxing behaviour of resolving
+	// a symlink component against the real filesystem, passed through
+	// to FS when FS is left nil. Off by default: a client cannot
+	// otherwise escape Root by walking through a symlink planted inside
+	// the served tree. Also settable via the -follow-symlinks flag.
+	FollowSymlinks bool
+
+	// FS is the backend that actually resolves the legacy (non-.L)
+	// handlers below. It defaults to a *LocalFS built from Root and
+	// FollowSymlinks, so existing callers that only ever set those two
+	// fields keep working unchanged; set FS directly to serve something
+	// other than a local directory tree.
+	FS Filesystem
+
+	fsOnce sync.Once
 }
 
 var addr = flag.String("addr", ":5640", "network address")
 var debug = flag.Int("d", 0, "print debug messages")
 var root = flag.String("root", "/", "root filesystem")
+var followSymlinksFlag = flag.Bool("follow-symlinks", false, "resolve symlinks against the real root instead of rejecting them")
+var streamDirsFlag = flag.Bool("stream-dirs", false, "stream directory reads instead of snapshotting them, for directories too large to hold in memory at once")
+
+// fs returns the Filesystem this Ufs drives its legacy handlers through,
+// defaulting to a *LocalFS built from Root/FollowSymlinks on first use.
+func (u *Ufs) fs() Filesystem {
+	u.fsOnce.Do(func() {
+		if u.FS == nil {
+			u.FS = &LocalFS{Root: u.Root, FollowSymlinks: u.FollowSymlinks}
+		}
+	})
+	return u.FS
+}
 
 func toError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
 	var ecode uint32
 
 	ename := err.Error()
@@ -59,14 +159,97 @@ func isChar(d os.FileInfo) bool {
 }
 
 func (fid *ufsFid) stat() *Error {
-	var err error
+	if err := statNode(fid); err != nil {
+		return toError(err)
+	}
+	return nil
+}
 
-	fid.st, err = os.Lstat(fid.path)
+// dupFd duplicates f's underlying descriptor, for handing an independent
+// reference to a fid that must outlive or diverge from the file it was
+// copied from (e.g. cloning a fid on a zero-length Walk).
+func dupFd(f *os.File) (*os.File, error) {
+	fd, err := unix.Dup(int(f.Fd()))
 	if err != nil {
-		return toError(err)
+		return nil, err
 	}
 
-	return nil
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// walkOne resolves a single path component relative to parent via openat,
+// refusing to follow symlinks (unless followSymlinks is set) and rejecting
+// any component that could itself attempt to escape parent.
+func walkOne(parent *os.File, name string, followSymlinks bool) (*os.File, error) {
+	if name == ".." || strings.Contains(name, "/") {
+		return nil, syscall.EINVAL
+	}
+
+	flags := unix.O_PATH | unix.O_CLOEXEC
+	if !followSymlinks {
+		flags |= unix.O_NOFOLLOW
+	}
+
+	fd, err := unix.Openat(int(parent.Fd()), name, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// walkPath resolves names in sequence starting at start, stopping at the
+// first component that fails to resolve. It returns the dirfd of the final
+// resolved component, the dirfd of its parent (nil if nothing resolved),
+// and the qid of each resolved component; a non-nil err reports why
+// resolution stopped short, if it did.
+func walkPath(start *os.File, names []string, followSymlinks bool) (parent, cur *os.File, qids []Qid, err error) {
+	cur, err = dupFd(start)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = nil
+
+	for _, name := range names {
+		child, e := walkOne(cur, name, followSymlinks)
+		if e != nil {
+			err = e
+			break
+		}
+
+		st, e := child.Stat()
+		if e != nil {
+			child.Close()
+			err = e
+			break
+		}
+
+		if parent != nil {
+			parent.Close()
+		}
+		parent = cur
+		cur = child
+		qids = append(qids, *dir2Qid(st))
+	}
+
+	return parent, cur, qids, err
+}
+
+// readlinkAt reads the target of the symlink named by name under dirfd, or
+// of dirfd itself when name is empty (via the /proc/self/fd magic link,
+// since an O_PATH|O_NOFOLLOW fd on a symlink can't be opened for reading).
+func readlinkAt(dirfd int, name string) (string, error) {
+	if name == "" {
+		return os.Readlink(fmt.Sprintf("/proc/self/fd/%d", dirfd))
+	}
+
+	buf := make([]byte, 4096)
+	n, err := unix.Readlinkat(dirfd, name, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf[:n]), nil
 }
 
 func omode2uflags(mode uint8) int {
@@ -161,19 +344,24 @@ type ufsDir struct {
 	Dir
 }
 
-func dir2Dir(path string, d os.FileInfo, dotu bool, upool Users) *Dir {
+// dir2Dir builds the wire Dir for name, whose symlink target (if any) is
+// fetched lazily through readlink, since resolving it takes a different
+// shape depending on whether the caller already has name's own dirfd (the
+// Stat path) or only its parent's dirfd plus name (the directory-read
+// path).
+func dir2Dir(name string, d os.FileInfo, dotu bool, upool Users, readlink func() (string, error)) *Dir {
 	sysMode := d.Sys().(*syscall.Stat_t)
 
 	dir := new(ufsDir)
 	dir.Qid = *dir2Qid(d)
 	dir.Mode = dir2Npmode(d, dotu)
-	dir.Atime = uint32(0/*atime(sysMode).Unix()*/)
+	dir.Atime = uint32(atime(sysMode).Unix())
 	dir.Mtime = uint32(d.ModTime().Unix())
 	dir.Length = uint64(d.Size())
-	dir.Name = path[strings.LastIndex(path, "/")+1:]
+	dir.Name = name
 
 	if dotu {
-		dir.dotu(path, d, upool, sysMode)
+		dir.dotu(d, upool, sysMode, readlink)
 		return &dir.Dir
 	}
 
@@ -197,7 +385,7 @@ func dir2Dir(path string, d os.FileInfo, dotu bool, upool Users) *Dir {
 	return &dir.Dir
 }
 
-func (dir *ufsDir) dotu(path string, d os.FileInfo, upool Users, sysMode *syscall.Stat_t) {
+func (dir *ufsDir) dotu(d os.FileInfo, upool Users, sysMode *syscall.Stat_t, readlink func() (string, error)) {
 	u := upool.Uid2User(int(sysMode.Uid))
 	g := upool.Gid2Group(int(sysMode.Gid))
 	dir.Uid = u.Name()
@@ -215,10 +403,11 @@ func (dir *ufsDir) dotu(path string, d os.FileInfo, upool Users, sysMode *syscal
 	dir.Gidnum = uint32(g.Id())
 	dir.Muidnum = NOUID
 	if d.Mode()&os.ModeSymlink != 0 {
-		var err error
-		dir.Ext, err = os.Readlink(path)
+		target, err := readlink()
 		if err != nil {
 			dir.Ext = ""
+		} else {
+			dir.Ext = target
 		}
 	} else if isBlock(d) {
 		dir.Ext = fmt.Sprintf("b %d %d", sysMode.Rdev>>24, sysMode.Rdev&0xFFFFFF)
@@ -239,126 +428,87 @@ func (*Ufs) ConnClosed(conn *Conn) {
 	}
 }
 
-func (*Ufs) FidDestroy(sfid *srvFid) {
-	var fid *ufsFid
-
+func (u *Ufs) FidDestroy(sfid *srvFid) {
 	if sfid.Aux == nil {
 		return
 	}
 
-	fid = sfid.Aux.(*ufsFid)
+	fid, ok := sfid.Aux.(*ufsFid)
+	if !ok {
+		return
+	}
+
+	if lfs, ok := u.FS.(*LocalFS); ok {
+		lfs.dirSnapshotCache().forget(fid)
+	}
 	if fid.file != nil {
 		fid.file.Close()
 	}
+	if fid.dirfd != nil {
+		fid.dirfd.Close()
+	}
+	if fid.parent != nil {
+		fid.parent.Close()
+	}
 }
 
-func (*Ufs) Attach(req *srvReq) {
+func (u *Ufs) Attach(req *srvReq) {
 	if req.Afid != nil {
 		req.RespondError(Enoauth)
 		return
 	}
 
-	tc := req.Tc
-	fid := new(ufsFid)
-	if len(tc.Aname) == 0 {
-		fid.path = *root
-	} else {
-		fid.path = tc.Aname
-	}
-
-	req.Fid.Aux = fid
-	err := fid.stat()
+	node, qid, err := u.fs().Root(context.Background(), req.Tc.Aname)
 	if err != nil {
-		req.RespondError(err)
+		req.RespondError(toError(err))
 		return
 	}
 
-	qid := dir2Qid(fid.st)
-	req.RespondRattach(qid)
+	req.Fid.Aux = node
+	req.RespondRattach(&qid)
 }
 
 func (*Ufs) Flush(req *srvReq) {}
 
-func (*Ufs) Walk(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
+func (u *Ufs) Walk(req *srvReq) {
 	tc := req.Tc
 
-	err := fid.stat()
-	if err != nil {
-		req.RespondError(err)
+	nnode, qids, err := u.fs().Walk(context.Background(), req.Fid.Aux, tc.Wname)
+	if err != nil && len(qids) == 0 && len(tc.Wname) > 0 {
+		req.RespondError(Enoent)
 		return
 	}
 
-	if req.Newfid.Aux == nil {
-		req.Newfid.Aux = new(srvFid)
-	}
-
-	nfid := req.Newfid.Aux.(*ufsFid)
-	wqids := make([]Qid, len(tc.Wname))
-	path := fid.path
-	i := 0
-	for ; i < len(tc.Wname); i++ {
-		p := path + "/" + tc.Wname[i]
-		st, err := os.Lstat(p)
-		if err != nil {
-			if i == 0 {
-				req.RespondError(Enoent)
-				return
-			}
-
-			break
-		}
-
-		wqids[i] = *dir2Qid(st)
-		path = p
-	}
-
-	nfid.path = path
-	req.RespondRwalk(wqids[0:i])
+	req.Newfid.Aux = nnode
+	req.RespondRwalk(qids)
 }
 
-func (*Ufs) Open(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
+func (u *Ufs) Open(req *srvReq) {
 	tc := req.Tc
-	err := fid.stat()
-	if err != nil {
-		req.RespondError(err)
-		return
-	}
 
-	var e error
-	fid.file, e = os.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
-	if e != nil {
-		req.RespondError(toError(e))
+	qid, err := u.fs().Open(context.Background(), req.Fid.Aux, uint8(tc.Mode))
+	if err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
-	req.RespondRopen(dir2Qid(fid.st), 0)
+	req.RespondRopen(&qid, 0)
 }
 
-func (*Ufs) Create(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
+func (u *Ufs) Create(req *srvReq) {
 	tc := req.Tc
-	err := fid.stat()
-	if err != nil {
-		req.RespondError(err)
+
+	if tc.Perm&DMNAMEDPIPE != 0 || tc.Perm&DMDEVICE != 0 {
+		req.RespondError(&Error{"not implemented", EIO})
 		return
 	}
 
-	path := fid.path + "/" + tc.Name
-	var e error = nil
-	var file *os.File = nil
-	switch {
-	case tc.Perm&DMDIR != 0:
-		e = os.Mkdir(path, os.FileMode(tc.Perm&0777))
-
-	case tc.Perm&DMSYMLINK != 0:
-		e = os.Symlink(tc.Ext, path)
-
-	case tc.Perm&DMLINK != 0:
-		n, e := strconv.ParseUint(tc.Ext, 10, 0)
-		if e != nil {
-			break
+	var link FsNode
+	if tc.Perm&DMLINK != 0 {
+		n, perr := strconv.ParseUint(tc.Ext, 10, 0)
+		if perr != nil {
+			req.RespondError(toError(perr))
+			return
 		}
 
 		ofid := req.Conn.FidGet(uint32(n))
@@ -366,127 +516,76 @@ func (*Ufs) Create(req *srvReq) {
 			req.RespondError(Eunknownfid)
 			return
 		}
-
-		e = os.Link(ofid.Aux.(*ufsFid).path, path)
+		link = ofid.Aux
 		ofid.DecRef()
-
-	case tc.Perm&DMNAMEDPIPE != 0:
-	case tc.Perm&DMDEVICE != 0:
-		req.RespondError(&Error{"not implemented", EIO})
-		return
-
-	default:
-		var mode uint32 = tc.Perm & 0777
-		if req.Conn.Dotu {
-			if tc.Perm&DMSETUID > 0 {
-				mode |= syscall.S_ISUID
-			}
-			if tc.Perm&DMSETGID > 0 {
-				mode |= syscall.S_ISGID
-			}
-		}
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE, os.FileMode(mode))
-	}
-
-	if file == nil && e == nil {
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode), 0)
-	}
-
-	if e != nil {
-		req.RespondError(toError(e))
-		return
 	}
 
-	fid.path = path
-	fid.file = file
-	err = fid.stat()
+	node, qid, err := u.fs().Create(context.Background(), req.Fid.Aux, tc.Name, tc.Perm, uint8(tc.Mode), tc.Ext, link, req.Conn.Dotu)
 	if err != nil {
-		req.RespondError(err)
+		req.RespondError(toError(err))
 		return
 	}
 
-	req.RespondRcreate(dir2Qid(fid.st), 0)
+	req.Fid.Aux = node
+	req.RespondRcreate(&qid, 0)
 }
 
-func (*Ufs) Read(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
+func (u *Ufs) Read(req *srvReq) {
 	tc := req.Tc
 	rc := req.Rc
-	err := fid.stat()
+	ctx := context.Background()
+
+	if fid, ok := req.Fid.Aux.(*ufsFid); ok && fid.xattrMode == xattrRead {
+		InitRread(rc, tc.Count)
+		n := 0
+		if tc.Offset < uint64(len(fid.xattrBuf)) {
+			n = copy(rc.Data, fid.xattrBuf[tc.Offset:])
+		}
+		SetRreadCount(rc, uint32(n))
+		req.Respond()
+		return
+	}
+
+	dir, err := u.fs().Stat(ctx, req.Fid.Aux, req.Conn.Dotu, req.Conn.Srv.Upool)
 	if err != nil {
-		req.RespondError(err)
+		req.RespondError(toError(err))
 		return
 	}
 
 	InitRread(rc, tc.Count)
 	var count int
 	var e error
-	if fid.st.IsDir() {
-		b := rc.Data
-		if tc.Offset == 0 {
-			fid.file.Close()
-			fid.file, e = os.OpenFile(fid.path, omode2uflags(req.Fid.Omode), 0)
-			if e != nil {
-				req.RespondError(toError(e))
-				return
-			}
-		}
 
-		for len(b) > 0 {
-			if fid.dirs == nil {
-				fid.dirs, e = fid.file.Readdir(16)
-				if e != nil && e != io.EOF {
-					req.RespondError(toError(e))
-					return
-				}
-
-				if len(fid.dirs) == 0 {
-					break
-				}
-			}
-
-			var i int
-			for i = 0; i < len(fid.dirs); i++ {
-				path := fid.path + "/" + fid.dirs[i].Name()
-				st := dir2Dir(path, fid.dirs[i], req.Conn.Dotu, req.Conn.Srv.Upool)
-				sz := PackDir(st, b, req.Conn.Dotu)
-				if sz == 0 {
-					break
-				}
-
-				b = b[sz:]
-				count += sz
-			}
-
-			if i < len(fid.dirs) {
-				fid.dirs = fid.dirs[i:]
-				break
-			} else {
-				fid.dirs = nil
-			}
-		}
+	if dir.Mode&DMDIR != 0 {
+		count, e = u.fs().Readdir(ctx, req.Fid.Aux, tc.Offset, rc.Data, req.Conn.Dotu, req.Conn.Srv.Upool)
 	} else {
-		count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
-		if e != nil && e != io.EOF {
-			req.RespondError(toError(e))
-			return
-		}
+		count, e = u.fs().ReadAt(ctx, req.Fid.Aux, rc.Data, int64(tc.Offset))
+	}
+	if e != nil && e != io.EOF {
+		req.RespondError(toError(e))
+		return
 	}
 
 	SetRreadCount(rc, uint32(count))
 	req.Respond()
 }
 
-func (*Ufs) Write(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
+func (u *Ufs) Write(req *srvReq) {
 	tc := req.Tc
-	err := fid.stat()
-	if err != nil {
-		req.RespondError(err)
+
+	if fid, ok := req.Fid.Aux.(*ufsFid); ok && fid.xattrMode == xattrWrite {
+		end := tc.Offset + uint64(len(tc.Data))
+		if end > uint64(len(fid.xattrBuf)) {
+			grown := make([]byte, end)
+			copy(grown, fid.xattrBuf)
+			fid.xattrBuf = grown
+		}
+		copy(fid.xattrBuf[tc.Offset:end], tc.Data)
+		req.RespondRwrite(uint32(len(tc.Data)))
 		return
 	}
 
-	n, e := fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	n, e := u.fs().WriteAt(context.Background(), req.Fid.Aux, tc.Data, int64(tc.Offset))
 	if e != nil {
 		req.RespondError(toError(e))
 		return
@@ -495,34 +594,42 @@ func (*Ufs) Write(req *srvReq) {
 	req.RespondRwrite(uint32(n))
 }
 
-func (*Ufs) Clunk(req *srvReq) { req.RespondRclunk() }
+func (*Ufs) Clunk(req *srvReq) {
+	fid, _ := req.Fid.Aux.(*ufsFid)
+	if fid != nil && fid.xattrMode == xattrWrite {
+		flags := 0
+		if fid.xattrFlags&XattrCreate != 0 {
+			flags |= xattrCreateFlag
+		}
+		if fid.xattrFlags&XattrReplace != 0 {
+			flags |= xattrReplaceFlag
+		}
 
-func (*Ufs) Remove(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
-	err := fid.stat()
-	if err != nil {
-		req.RespondError(err)
-		return
+		if e := setxattr(fid.procPath(), fid.xattrName, fid.xattrBuf, flags); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
 	}
 
-	e := os.Remove(fid.path)
-	if e != nil {
-		req.RespondError(toError(e))
+	req.RespondRclunk()
+}
+
+func (u *Ufs) Remove(req *srvReq) {
+	if err := u.fs().Remove(context.Background(), req.Fid.Aux); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
 	req.RespondRremove()
 }
 
-func (*Ufs) Stat(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
-	err := fid.stat()
+func (u *Ufs) Stat(req *srvReq) {
+	st, err := u.fs().Stat(context.Background(), req.Fid.Aux, req.Conn.Dotu, req.Conn.Srv.Upool)
 	if err != nil {
-		req.RespondError(err)
+		req.RespondError(toError(err))
 		return
 	}
 
-	st := dir2Dir(fid.path, fid.st, req.Conn.Dotu, req.Conn.Srv.Upool)
 	req.RespondRstat(st)
 }
 
@@ -545,106 +652,12 @@ func lookup(uid string, group bool) (uint32, *Error) {
 	return uint32(u), nil
 }
 
-func (*Ufs) Wstat(req *srvReq) {
-	fid := req.Fid.Aux.(*ufsFid)
-	err := fid.stat()
-	if err != nil {
-		req.RespondError(err)
+func (u *Ufs) Wstat(req *srvReq) {
+	if err := u.fs().Wstat(context.Background(), req.Fid.Aux, &req.Tc.Dir, req.Conn.Dotu); err != nil {
+		req.RespondError(toError(err))
 		return
 	}
 
-	dir := &req.Tc.Dir
-	if dir.Mode != 0xFFFFFFFF {
-		mode := dir.Mode & 0777
-		if req.Conn.Dotu {
-			if dir.Mode&DMSETUID > 0 {
-				mode |= syscall.S_ISUID
-			}
-			if dir.Mode&DMSETGID > 0 {
-				mode |= syscall.S_ISGID
-			}
-		}
-		e := os.Chmod(fid.path, os.FileMode(mode))
-		if e != nil {
-			req.RespondError(toError(e))
-			return
-		}
-	}
-
-	uid, gid := NOUID, NOUID
-	if req.Conn.Dotu {
-		uid = dir.Uidnum
-		gid = dir.Gidnum
-	}
-
-	// Try to find local uid, gid by name.
-	if (dir.Uid != "" || dir.Gid != "") && !req.Conn.Dotu {
-		uid, err = lookup(dir.Uid, false)
-		if err != nil {
-			req.RespondError(err)
-			return
-		}
-
-		// BUG(akumar): Lookup will never find gids
-		// corresponding to group names, because
-		// it only operates on user names.
-		gid, err = lookup(dir.Gid, true)
-		if err != nil {
-			req.RespondError(err)
-			return
-		}
-	}
-
-	if uid != NOUID || gid != NOUID {
-		e := os.Chown(fid.path, int(uid), int(gid))
-		if e != nil {
-			req.RespondError(toError(e))
-			return
-		}
-	}
-
-	if dir.Name != "" {
-		path := fid.path[0:strings.LastIndex(fid.path, "/")+1] + "/" + dir.Name
-		err := syscall.Rename(fid.path, path)
-		if err != nil {
-			req.RespondError(toError(err))
-			return
-		}
-		fid.path = path
-	}
-
-	if dir.Length != 0xFFFFFFFFFFFFFFFF {
-		e := os.Truncate(fid.path, int64(dir.Length))
-		if e != nil {
-			req.RespondError(toError(e))
-			return
-		}
-	}
-
-	// If either mtime or atime need to be changed, then
-	// we must change both.
-	if dir.Mtime != ^uint32(0) || dir.Atime != ^uint32(0) {
-		mt, at := time.Unix(int64(dir.Mtime), 0), time.Unix(int64(dir.Atime), 0)
-		if cmt, cat := (dir.Mtime == ^uint32(0)), (dir.Atime == ^uint32(0)); cmt || cat {
-			st, e := os.Stat(fid.path)
-			if e != nil {
-				req.RespondError(toError(e))
-				return
-			}
-			switch cmt {
-			case true:
-				mt = st.ModTime()
-			default:
-				//at = time.Time(0)//atime(st.Sys().(*syscall.Stat_t))
-			}
-		}
-		e := os.Chtimes(fid.path, at, mt)
-		if e != nil {
-			req.RespondError(toError(e))
-			return
-		}
-	}
-
 	req.RespondRwstat()
 }
 
@@ -0,0 +1,686 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// dir2Attr builds the stat_x-like Dotlattr that Rgetattr returns, using the
+// same os.FileInfo/syscall.Stat_t a legacy Rstat is built from.
+func dir2Attr(d os.FileInfo) *Dotlattr {
+	sysMode := d.Sys().(*syscall.Stat_t)
+
+	attr := new(Dotlattr)
+	attr.Valid = GetattrBasic
+	attr.Qid = *dir2Qid(d)
+	attr.Mode = uint32(sysMode.Mode)
+	attr.Uid = sysMode.Uid
+	attr.Gid = sysMode.Gid
+	attr.Nlink = uint64(sysMode.Nlink)
+	attr.Rdev = uint64(sysMode.Rdev)
+	attr.Size = uint64(d.Size())
+	attr.Blksize = uint64(sysMode.Blksize)
+	attr.Blocks = uint64(sysMode.Blocks)
+	attr.Mtime_sec = uint64(d.ModTime().Unix())
+	attr.Mtime_nsec = uint64(d.ModTime().Nanosecond())
+	at, ct := atime(sysMode), ctime(sysMode)
+	attr.Atime_sec = uint64(at.Unix())
+	attr.Atime_nsec = uint64(at.Nanosecond())
+	attr.Ctime_sec = uint64(ct.Unix())
+	attr.Ctime_nsec = uint64(ct.Nanosecond())
+
+	return attr
+}
+
+// Getattr implements Tgetattr, the .L replacement for Tstat.
+func (*Ufs) Getattr(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRgetattr(dir2Attr(fid.st))
+}
+
+// Setattr implements Tsetattr, the .L replacement for the overloaded Wstat
+// path: each field is only touched when its bit is set in Valid, rather
+// than relying on legacy Dir's "unset == all-ones" convention.
+func (*Ufs) Setattr(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	sa := req.Tc.Setattr
+	procPath := fid.procPath()
+	if sa.Valid&AttrMode != 0 {
+		// Tsetattr's Mode is a raw POSIX mode_t, setuid/setgid/sticky
+		// bits and all; go through unix.Fchmodat with the full 07777
+		// mask instead of os.Chmod(os.FileMode(...)), since an
+		// os.FileMode's own Setuid/Setgid/Sticky bits live at
+		// different positions than the raw mode_t ones and would
+		// silently swallow them.
+		if e := unix.Fchmodat(unix.AT_FDCWD, procPath, sa.Mode&07777, 0); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if sa.Valid&(AttrUid|AttrGid) != 0 {
+		uid, gid := -1, -1
+		if sa.Valid&AttrUid != 0 {
+			uid = int(sa.Uid)
+		}
+		if sa.Valid&AttrGid != 0 {
+			gid = int(sa.Gid)
+		}
+		if e := os.Chown(procPath, uid, gid); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if sa.Valid&AttrSize != 0 {
+		if e := os.Truncate(procPath, int64(sa.Size)); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	// Each timestamp axis is independent: ATIME_SET/MTIME_SET carries an
+	// explicit value, ATIME/MTIME without _SET means "now" (the
+	// utimensat UTIME_NOW convention), and the axis being unset in Valid
+	// at all means UTIME_OMIT, matching what utimensat(UTIME_OMIT)
+	// round-trips as. CTIME has no direct setter on Linux; chmod/chown/
+	// truncate/utimes all bump it as a side effect already, so Valid&
+	// AttrCtime needs no handling of its own here.
+	if sa.Valid&(AttrAtime|AttrMtime) != 0 {
+		ts := [2]unix.Timespec{omitTimespec(), omitTimespec()}
+		switch {
+		case sa.Valid&AttrAtime == 0:
+		case sa.Valid&AttrAtimeSet != 0:
+			ts[0] = unix.NsecToTimespec(time.Unix(int64(sa.AtimeSec), int64(sa.AtimeNsec)).UnixNano())
+		default:
+			ts[0] = unix.Timespec{Sec: 0, Nsec: unix.UTIME_NOW}
+		}
+		switch {
+		case sa.Valid&AttrMtime == 0:
+		case sa.Valid&AttrMtimeSet != 0:
+			ts[1] = unix.NsecToTimespec(time.Unix(int64(sa.MtimeSec), int64(sa.MtimeNsec)).UnixNano())
+		default:
+			ts[1] = unix.Timespec{Sec: 0, Nsec: unix.UTIME_NOW}
+		}
+		if e := unix.UtimesNanoAt(unix.AT_FDCWD, procPath, ts[:], 0); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	err = fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRsetattr()
+}
+
+// Readdir implements Treaddir: fixed-size dirents (qid, offset, type, name)
+// instead of the packed variable-width Dir records Tread produces. It
+// serves "." and ".." followed by LocalFS's snapshot (see dirSnapshot):
+// each dirent's Offset is its position in that listing plus one, i.e. the
+// offset a client sends to resume after it, which like a legacy Tread's
+// byte cookie stays a stable identity regardless of how many other
+// Treaddirs have happened since.
+func (u *Ufs) Readdir(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+
+	lfs, ok := u.FS.(*LocalFS)
+	if !ok {
+		req.RespondError(Eunknownfid)
+		return
+	}
+
+	snap, e := lfs.dirSnapshotFor(fid, req.Conn.Dotu, req.Conn.Srv.Upool)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	dots, e := dotDirents(fid)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	var ents []Dotldirent
+	var size uint32
+	for i := int(tc.Offset); i < len(dots)+len(snap.entries); i++ {
+		var ent Dotldirent
+		if i < len(dots) {
+			ent = dots[i]
+		} else {
+			d := snap.entries[i-len(dots)]
+			ent = Dotldirent{
+				Qid:  d.Qid,
+				Type: uint8(d.Qid.Type),
+				Name: d.Name,
+			}
+		}
+		ent.Offset = uint64(i) + 1
+
+		entsz := direntSize(&ent)
+		if size+entsz > tc.Count {
+			break
+		}
+
+		ents = append(ents, ent)
+		size += entsz
+	}
+
+	req.RespondRreaddir(ents)
+}
+
+// dotDirents synthesizes the "." and ".." entries a Treaddir client
+// expects at offsets 0 and 1, the way gVisor's fsgofer (what this
+// request is modeled on) does: f.Readdir only ever yields real children,
+// so without this ls -a and getdents(2) over the mount would never see
+// either dot entry. "." is fid's own qid; ".." is its parent's, or its
+// own again at the attach root, which has no parent to escape to.
+func dotDirents(fid *ufsFid) ([]Dotldirent, error) {
+	self, err := fid.dirfd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	parentInfo := self
+	if fid.parent != nil {
+		parentInfo, err = fid.parent.Stat()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	selfQid, parentQid := dir2Qid(self), dir2Qid(parentInfo)
+	return []Dotldirent{
+		{Qid: *selfQid, Type: uint8(selfQid.Type), Name: "."},
+		{Qid: *parentQid, Type: uint8(parentQid.Type), Name: ".."},
+	}, nil
+}
+
+// Mknod implements Tmknod: create a device, fifo or socket node via
+// unix.Mknodat rather than the legacy DMDEVICE "not implemented" branch in
+// Create.
+func (*Ufs) Mknod(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	dev := int(unix.Mkdev(tc.Major, tc.Minor))
+	if e := unix.Mknodat(int(fid.dirfd.Fd()), tc.Name, tc.Mode, dev); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	child, e := walkOne(fid.dirfd, tc.Name, false)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+	defer child.Close()
+
+	st, e := child.Stat()
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRmknod(dir2Qid(st))
+}
+
+// Mkdir implements Tmkdir, replacing the DMDIR case of Create for .L
+// clients, which pass the directory name and mode directly rather than
+// threading them through the open-or-create Create message.
+func (*Ufs) Mkdir(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if e := unix.Mkdirat(int(fid.dirfd.Fd()), tc.Name, uint32(tc.Mode&0777)); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	child, e := walkOne(fid.dirfd, tc.Name, false)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+	defer child.Close()
+
+	st, e := child.Stat()
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRmkdir(dir2Qid(st))
+}
+
+// Symlink implements Tsymlink.
+func (*Ufs) Symlink(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if e := unix.Symlinkat(tc.Target, int(fid.dirfd.Fd()), tc.Name); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	child, e := walkOne(fid.dirfd, tc.Name, false)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+	defer child.Close()
+
+	st, e := child.Stat()
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRsymlink(dir2Qid(st))
+}
+
+// Readlink implements Treadlink.
+func (*Ufs) Readlink(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	target, e := readlinkAt(int(fid.dirfd.Fd()), "")
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRreadlink(target)
+}
+
+// Link implements Tlink: hard-link an existing fid into this directory
+// under a new name.
+func (*Ufs) Link(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+
+	ofid := req.Conn.FidGet(tc.Fid)
+	if ofid == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+	defer ofid.DecRef()
+
+	oaux := ofid.Aux.(*ufsFid)
+	e := unix.Linkat(int(oaux.dirfd.Fd()), "", int(fid.dirfd.Fd()), tc.Name, unix.AT_EMPTY_PATH)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRlink()
+}
+
+// Rename implements Trename: move the file behind req.Fid into dir fid
+// dfid under the given name.
+func (*Ufs) Rename(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+
+	if fid.parent == nil {
+		req.RespondError(toError(syscall.EBUSY))
+		return
+	}
+
+	dfid := req.Conn.FidGet(tc.Dfid)
+	if dfid == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+	defer dfid.DecRef()
+
+	newParent := dfid.Aux.(*ufsFid)
+	if e := unix.Renameat(int(fid.parent.Fd()), fid.name, int(newParent.dirfd.Fd()), tc.Name); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	np, e := dupFd(newParent.dirfd)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+	fid.parent.Close()
+	fid.parent = np
+	fid.name = tc.Name
+
+	req.RespondRrename()
+}
+
+// Renameat implements Trenameat: rename within (and possibly between) two
+// directory fids without requiring the moved file itself have a live fid.
+func (*Ufs) Renameat(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	tc := req.Tc
+
+	ofid := req.Conn.FidGet(tc.Olddirfid)
+	if ofid == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+	defer ofid.DecRef()
+
+	nfid := req.Conn.FidGet(tc.Newdirfid)
+	if nfid == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+	defer nfid.DecRef()
+
+	oaux := ofid.Aux.(*ufsFid)
+	naux := nfid.Aux.(*ufsFid)
+	e := unix.Renameat(int(oaux.dirfd.Fd()), tc.Oldname, int(naux.dirfd.Fd()), tc.Newname)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRrenameat()
+}
+
+// Unlinkat implements Tunlinkat: remove a name out of a directory fid,
+// honoring AT_REMOVEDIR in flags.
+func (*Ufs) Unlinkat(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	tc := req.Tc
+
+	dfid := req.Conn.FidGet(tc.Dirfid)
+	if dfid == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+	defer dfid.DecRef()
+
+	flags := 0
+	if tc.Flags&unix.AT_REMOVEDIR != 0 {
+		flags = unix.AT_REMOVEDIR
+	}
+
+	daux := dfid.Aux.(*ufsFid)
+	if e := unix.Unlinkat(int(daux.dirfd.Fd()), tc.Name, flags); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRunlinkat()
+}
+
+// Lopen implements Tlopen: open (or, for directories, prepare to readdir) a
+// fid using the client's raw Linux O_* flags instead of the legacy 9P open
+// mode byte.
+func (*Ufs) Lopen(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	f, e := fid.open(int(tc.Flags))
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+	fid.file = f
+
+	req.RespondRlopen(dir2Qid(fid.st), 0)
+}
+
+// Lcreate implements Tlcreate: create-and-open in one round trip using raw
+// O_* flags, the .L counterpart of the default branch of Create.
+func (*Ufs) Lcreate(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	fd, e := unix.Openat(int(fid.dirfd.Fd()), tc.Name, int(tc.Flags)|unix.O_CREAT, tc.Mode&0777)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+	file := os.NewFile(uintptr(fd), tc.Name)
+
+	child, e := walkOne(fid.dirfd, tc.Name, false)
+	if e != nil {
+		file.Close()
+		req.RespondError(toError(e))
+		return
+	}
+
+	if fid.parent != nil {
+		fid.parent.Close()
+	}
+	fid.parent = fid.dirfd
+	fid.dirfd = child
+	fid.name = tc.Name
+	fid.file = file
+
+	err = fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRlcreate(dir2Qid(fid.st), 0)
+}
+
+// Fsync implements Tfsync.
+func (*Ufs) Fsync(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	if fid.file == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+
+	if e := fid.file.Sync(); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRfsync()
+}
+
+// Statfs implements Tstatfs.
+func (*Ufs) Statfs(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+
+	var st syscall.Statfs_t
+	if e := syscall.Fstatfs(int(fid.dirfd.Fd()), &st); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRstatfs(&Statfs{
+		Type:    uint32(st.Type),
+		Bsize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Namelen: uint32(st.Namelen),
+	})
+}
+
+// Getlock implements Tgetlock: a non-blocking, non-mutating F_GETLK probe.
+func (*Ufs) Getlock(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	if fid.file == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+
+	gl := req.Tc.Getlock
+	flk := syscall.Flock_t{
+		Type:   int16(gl.Type),
+		Whence: int16(os.SEEK_SET),
+		Start:  int64(gl.Start),
+		Len:    int64(gl.Length),
+	}
+	if e := syscall.FcntlFlock(fid.file.Fd(), syscall.F_GETLK, &flk); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRgetlock(&Getlock{
+		Type:   uint8(flk.Type),
+		Start:  uint64(flk.Start),
+		Length: uint64(flk.Len),
+		Pid:    uint32(flk.Pid),
+	})
+}
+
+// Lock implements Tlock: a POSIX advisory lock request (F_SETLK, or
+// F_SETLKW when the blocking bit is set).
+func (*Ufs) Lock(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	if fid.file == nil {
+		req.RespondError(Eunknownfid)
+		return
+	}
+
+	fl := req.Tc.Flock
+	flk := syscall.Flock_t{
+		Type:   int16(fl.Type),
+		Whence: int16(os.SEEK_SET),
+		Start:  int64(fl.Start),
+		Len:    int64(fl.Length),
+		Pid:    int32(fl.Pid),
+	}
+
+	cmd := syscall.F_SETLK
+	if fl.Flags&1 != 0 {
+		cmd = syscall.F_SETLKW
+	}
+
+	e := syscall.FcntlFlock(fid.file.Fd(), cmd, &flk)
+	status := uint8(LockSuccess)
+	if e != nil {
+		if e == syscall.EAGAIN || e == syscall.EACCES {
+			status = LockBlocked
+		} else {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	req.RespondRlock(status)
+}
+
+func direntSize(ent *Dotldirent) uint32 {
+	// 13 (qid) + 8 (offset) + 1 (type) + 2 (name length prefix) + name
+	return uint32(13 + 8 + 1 + 2 + len(ent.Name))
+}
@@ -0,0 +1,98 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package go9p
+
+import "os"
+
+// Xattrwalk implements Txattrwalk: clone req.Fid into req.Newfid and rewind
+// it so that Treads return either the named xattr's value, or, when Name is
+// empty, the null-separated list of xattr names. The size of what a Tread
+// will return is reported back immediately so the client can size its
+// buffer.
+func (*Ufs) Xattrwalk(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+
+	dirfd, err := dupFd(fid.dirfd)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	var parent *os.File
+	if fid.parent != nil {
+		if parent, err = dupFd(fid.parent); err != nil {
+			dirfd.Close()
+			req.RespondError(toError(err))
+			return
+		}
+	}
+
+	var buf []byte
+	var e error
+	if tc.Name == "" {
+		buf, e = listxattr(procPathFor(dirfd))
+	} else {
+		buf, e = getxattr(procPathFor(dirfd), tc.Name)
+	}
+	if e != nil {
+		dirfd.Close()
+		if parent != nil {
+			parent.Close()
+		}
+		req.RespondError(toError(e))
+		return
+	}
+
+	if req.Newfid.Aux == nil {
+		req.Newfid.Aux = new(ufsFid)
+	}
+	nfid := req.Newfid.Aux.(*ufsFid)
+	nfid.dirfd = dirfd
+	nfid.parent = parent
+	nfid.name = fid.name
+	nfid.xattrMode = xattrRead
+	nfid.xattrName = tc.Name
+	nfid.xattrBuf = buf
+
+	req.RespondRxattrwalk(uint64(len(buf)))
+}
+
+// Xattrcreate implements Txattrcreate: req.Fid has just been walked to the
+// file that will carry the attribute. Put it into xattr-write mode so that
+// the Twrites which follow accumulate into xattrBuf; Tclunk is what
+// actually calls setxattr (see Ufs.Clunk).
+func (*Ufs) Xattrcreate(req *srvReq) {
+	if !requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*ufsFid)
+	tc := req.Tc
+
+	fid.xattrMode = xattrWrite
+	fid.xattrName = tc.Name
+	fid.xattrFlags = tc.Flags
+	fid.xattrBuf = make([]byte, 0, tc.Size)
+
+	req.RespondRxattrcreate()
+}
+
+// RespondRxattrwalk and RespondRxattrcreate were never declared anywhere
+// in this package (see RespondR* in dotl.go for the rest of the .L/xattr
+// wire plumbing this tree was missing); add them following the same
+// fill-Rc-then-Respond convention.
+func (req *srvReq) RespondRxattrwalk(size uint64) {
+	req.Rc.Size = size
+	req.Respond()
+}
+
+func (req *srvReq) RespondRxattrcreate() {
+	req.Respond()
+}
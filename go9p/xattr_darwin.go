@@ -0,0 +1,52 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin
+
+package go9p
+
+import "golang.org/x/sys/unix"
+
+// xattrCreateFlag/xattrReplaceFlag are the setxattr flag values Darwin
+// expects for XATTR_CREATE/XATTR_REPLACE.
+const (
+	xattrCreateFlag  = unix.XATTR_CREATE
+	xattrReplaceFlag = unix.XATTR_REPLACE
+)
+
+func getxattr(path, name string) ([]byte, error) {
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Getxattr(path, name, buf, 0, 0)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func listxattr(path string) ([]byte, error) {
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Listxattr(path, buf, 0)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func setxattr(path, name string, value []byte, flags int) error {
+	return unix.Setxattr(path, name, value, 0, flags)
+}
+
+func removexattr(path, name string) error {
+	return unix.Removexattr(path, name, 0)
+}
@@ -0,0 +1,54 @@
+// Copyright 2009 The go9p Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package go9p
+
+import "golang.org/x/sys/unix"
+
+// xattrCreateFlag/xattrReplaceFlag are the setxattr flag values Linux
+// expects; they happen to line up with the wire XattrCreate/XattrReplace
+// bits, but we keep them as distinct named constants since that's not true
+// on every OS (see xattr_darwin.go).
+const (
+	xattrCreateFlag  = unix.XATTR_CREATE
+	xattrReplaceFlag = unix.XATTR_REPLACE
+)
+
+func getxattr(path, name string) ([]byte, error) {
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Getxattr(path, name, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func listxattr(path string) ([]byte, error) {
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Listxattr(path, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func setxattr(path, name string, value []byte, flags int) error {
+	return unix.Setxattr(path, name, value, flags)
+}
+
+func removexattr(path, name string) error {
+	return unix.Removexattr(path, name)
+}